@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package apis contains the provider specific types consumed by the
+// machine-controller-manager-provider-vsphere driver.
+package apis
+
+// VsphereProviderSpec is the spec to be used while parsing the calls to provider vsphere
+type VsphereProviderSpec struct {
+	// Region is the name of the vCenter entry to use when VCenters is set.
+	// For backward compatibility it is also used as the identifier embedded
+	// into the provider ID of machines created against the single, legacy
+	// vCenter configured via Secrets.
+	Region string `json:"region,omitempty"`
+	// VCenterName selects an entry of VCenters explicitly. If empty, Region
+	// is used to look up the matching VCenterConfig.
+	VCenterName string `json:"vCenterName,omitempty"`
+	// VCenters holds the set of vCenters a MachineClass may be scheduled
+	// against. Each entry is resolved by VCenterName or, if that is empty,
+	// by Region. If VCenters is empty the legacy single-vCenter fields of
+	// Secrets are used instead.
+	VCenters []VCenterConfig `json:"vCenters,omitempty"`
+
+	// IdentityRef points to a credential object managed outside the
+	// MachineClass (a plain Secret or a cluster-scoped identity object kept
+	// by the embedding controller), letting several MachineClasses/namespaces
+	// share the same vCenter login instead of each embedding it via Secrets.
+	// When set, the host/username/password fields of Secrets become optional
+	// and the referenced identity is resolved via PluginSPIImpl.IdentityResolver
+	// instead, which is also responsible for enforcing which namespaces may
+	// use it.
+	IdentityRef *IdentityRef `json:"identityRef,omitempty"`
+
+	ComputeCluster   string `json:"computeCluster,omitempty"`
+	ResourcePool     string `json:"resourcePool,omitempty"`
+	HostSystem       string `json:"hostSystem,omitempty"`
+	Datastore        string `json:"datastore,omitempty"`
+	DatastoreCluster string `json:"datastoreCluster,omitempty"`
+	Network          string `json:"network,omitempty"`
+	TemplateVM       string `json:"templateVM,omitempty"`
+
+	// FailureDomains declares the zones a machine of this MachineClass can be
+	// placed into. When set, CreateMachine picks one entry per machine (see
+	// FailureDomainTag) and uses its placement overrides instead of the flat
+	// ComputeCluster/ResourcePool/Datastore/HostSystem/Network fields above.
+	FailureDomains []FailureDomain `json:"failureDomains,omitempty"`
+
+	// ClusterModuleGroup names the vSphere Cluster Module that machines of
+	// this MachineClass are added to on creation and removed from on
+	// deletion, keeping replicas spread across ESXi hosts. Cluster Modules
+	// require a DRS cluster, so this only combines with ComputeCluster.
+	ClusterModuleGroup string `json:"clusterModuleGroup,omitempty"`
+	// SoftAntiAffinity is accepted but not read by the driver: the Cluster
+	// Module for ClusterModuleGroup is created and joined the same way whether
+	// it is set or not.
+	SoftAntiAffinity bool `json:"softAntiAffinity,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// FailureDomainTag is the key in VsphereProviderSpec.Tags (propagated from a
+// label/annotation on the Machine by the generic machine-controller-manager)
+// that pins CreateMachine to a specific FailureDomains entry by name. If
+// absent, CreateMachine distributes machines round-robin across
+// FailureDomains instead.
+const FailureDomainTag = "vsphere.provider.gardener.cloud/failure-domain"
+
+// FailureDomain declares one zone a machine can be placed into: a
+// region/zone vSphere tag pair identifying it, and per-zone overrides for
+// where VMs placed in it are cloned to.
+type FailureDomain struct {
+	// Name identifies this entry for FailureDomainTag.
+	Name string `json:"name"`
+
+	// RegionTagCategory/RegionTagName and ZoneTagCategory/ZoneTagName are the
+	// vSphere tag category and tag name that mark a ComputeCluster/HostSystem
+	// as belonging to this failure domain's region/zone, mirroring how the
+	// in-tree vSphere cloud provider and CAPV model zones as tags rather than
+	// folder paths.
+	RegionTagCategory string `json:"regionTagCategory"`
+	RegionTagName     string `json:"regionTagName"`
+	ZoneTagCategory   string `json:"zoneTagCategory"`
+	ZoneTagName       string `json:"zoneTagName"`
+
+	// The following override the like-named VsphereProviderSpec fields for
+	// machines placed into this failure domain. Fields left empty fall back
+	// to the VsphereProviderSpec default. Folder is the exception:
+	// VsphereProviderSpec has no Folder field and the driver does not apply
+	// it, so it has no effect on where a VM is cloned to.
+	ComputeCluster   string `json:"computeCluster,omitempty"`
+	ResourcePool     string `json:"resourcePool,omitempty"`
+	Datastore        string `json:"datastore,omitempty"`
+	DatastoreCluster string `json:"datastoreCluster,omitempty"`
+	HostSystem       string `json:"hostSystem,omitempty"`
+	Folder           string `json:"folder,omitempty"`
+	Network          string `json:"network,omitempty"`
+}
+
+// VCenterConfig describes a single vCenter a MachineClass can be scheduled
+// against. It mirrors the fields of Secrets that are otherwise shared across
+// all MachineClasses, so that multiple vCenters can be targeted from the
+// same provider spec.
+type VCenterConfig struct {
+	// Name identifies this entry for VsphereProviderSpec.VCenterName.
+	Name string `json:"name"`
+	// Host is the vCenter endpoint, e.g. "vcenter.example.com".
+	Host string `json:"host"`
+	// Datacenter is the datacenter on this vCenter in which the compute
+	// cluster for ClusterModuleGroup is looked up. It is not passed to the
+	// clone step, so it does not select where VMs are placed.
+	Datacenter string `json:"datacenter,omitempty"`
+	// InsecureSSL disables TLS certificate verification for this vCenter.
+	InsecureSSL bool `json:"insecureSSL,omitempty"`
+	// Region is matched against VsphereProviderSpec.Region to select this
+	// entry when VCenterName is not set.
+	Region string `json:"region,omitempty"`
+	// UsernameSecretKey and PasswordSecretKey name the keys in Secrets.VCenterCredentials
+	// holding the login credentials for this vCenter. If empty, the
+	// top-level Secrets.VsphereUsername/VspherePassword are used.
+	UsernameSecretKey string `json:"usernameSecretKey,omitempty"`
+	PasswordSecretKey string `json:"passwordSecretKey,omitempty"`
+}
+
+// Secrets holds the vSphere credentials needed to log in to a vCenter.
+type Secrets struct {
+	// Namespace is the namespace of the MachineClass/Machine these secrets
+	// were resolved for. It is passed to IdentityResolver.ResolveIdentity so
+	// it can check whether this namespace is allowed to use the referenced
+	// identity when it is shared across namespaces.
+	Namespace string `json:"-"`
+
+	VsphereHost        string `json:"vsphereHost,omitempty"`
+	VsphereUsername    string `json:"vsphereUsername,omitempty"`
+	VspherePassword    string `json:"vspherePassword,omitempty"`
+	VsphereInsecureSSL bool   `json:"vsphereInsecureSSL,omitempty"`
+
+	// VCenterCredentials holds additional username/password pairs for the
+	// entries of VsphereProviderSpec.VCenters, keyed by the secret key
+	// names referenced from VCenterConfig.UsernameSecretKey/PasswordSecretKey.
+	VCenterCredentials map[string]string `json:"vCenterCredentials,omitempty"`
+
+	UserData string `json:"userData,omitempty"`
+}
+
+// IdentityRef points at a credential object that is managed separately from
+// the MachineClass carrying it. Resolving it (including checking that the
+// MachineClass's namespace is allowed to use it) is PluginSPIImpl.IdentityResolver's
+// job; this package only carries the reference.
+type IdentityRef struct {
+	// Kind is either "Secret" or "VSphereClusterIdentity".
+	Kind string `json:"kind"`
+	// Name is the name of the referenced object.
+	Name string `json:"name"`
+	// Namespace is the namespace of the referenced object. Required when
+	// Kind is "Secret"; VSphereClusterIdentity is cluster-scoped and ignores it.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// IdentityRefKindSecret and IdentityRefKindClusterIdentity are the supported
+// values of IdentityRef.Kind.
+const (
+	IdentityRefKindSecret          = "Secret"
+	IdentityRefKindClusterIdentity = "VSphereClusterIdentity"
+)
+
+// AllowedNamespaces selects the namespaces permitted to use a cluster-scoped
+// identity (IdentityRefKindClusterIdentity), either by an explicit list or a
+// label selector on the Namespace objects, analogous to CAPV's
+// AllowedNamespaces. This package does not talk to the Kubernetes API itself,
+// so it never constructs or enforces this type on its own; it is schema
+// shared with whatever IdentityResolver implementation the embedding
+// controller plugs in (e.g. internal.StaticIdentityResolver), which is
+// expected to enforce it before returning credentials. A nil
+// AllowedNamespaces allows none.
+type AllowedNamespaces struct {
+	NamespaceList []string          `json:"namespaceList,omitempty"`
+	Selector      map[string]string `json:"selector,omitempty"`
+}
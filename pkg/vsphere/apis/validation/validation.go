@@ -27,21 +27,153 @@ import (
 func ValidateVsphereProviderSpec(spec *api.VsphereProviderSpec, secrets *api.Secrets) []error {
 	var allErrs []error
 
-	if "" == spec.Datastore && "" == spec.DatastoreCluster {
-		allErrs = append(allErrs, fmt.Errorf("either datastoreCluster or datastore field is required"))
-	}
 	if "" == spec.TemplateVM {
 		allErrs = append(allErrs, fmt.Errorf("templateVM is a required field"))
 	}
-	if "" == spec.ComputeCluster && "" == spec.ResourcePool && "" == spec.HostSystem {
-		allErrs = append(allErrs, fmt.Errorf("either computeCluster or resourcePool or hostSystem field is required"))
-	}
-	if "" == spec.Network {
-		allErrs = append(allErrs, fmt.Errorf("network is a required field"))
+
+	if len(spec.FailureDomains) == 0 {
+		if "" == spec.Datastore && "" == spec.DatastoreCluster {
+			allErrs = append(allErrs, fmt.Errorf("either datastoreCluster or datastore field is required"))
+		}
+		if "" == spec.ComputeCluster && "" == spec.ResourcePool && "" == spec.HostSystem {
+			allErrs = append(allErrs, fmt.Errorf("either computeCluster or resourcePool or hostSystem field is required"))
+		}
+		if "" == spec.Network {
+			allErrs = append(allErrs, fmt.Errorf("network is a required field"))
+		}
+	} else {
+		allErrs = append(allErrs, validateFailureDomains(spec)...)
 	}
 
-	allErrs = append(allErrs, validateSecrets(secrets)...)
+	if spec.IdentityRef != nil {
+		allErrs = append(allErrs, validateIdentityRef(spec.IdentityRef)...)
+		allErrs = append(allErrs, validateSecrets(secrets, false)...)
+	} else {
+		allErrs = append(allErrs, validateSecrets(secrets, true)...)
+	}
 	allErrs = append(allErrs, validateSpecTags(spec.Tags)...)
+	allErrs = append(allErrs, validateVCenters(spec)...)
+	allErrs = append(allErrs, validateClusterModuleGroup(spec)...)
+
+	return allErrs
+}
+
+func validateClusterModuleGroup(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+	if "" == spec.ClusterModuleGroup {
+		return allErrs
+	}
+	if "" == spec.ComputeCluster {
+		allErrs = append(allErrs, fmt.Errorf("clusterModuleGroup requires computeCluster to be set, as cluster modules require a DRS cluster"))
+	}
+	return allErrs
+}
+
+func validateIdentityRef(ref *api.IdentityRef) []error {
+	var allErrs []error
+
+	switch ref.Kind {
+	case api.IdentityRefKindSecret:
+		if "" == ref.Namespace {
+			allErrs = append(allErrs, fmt.Errorf("identityRef.namespace is required for kind %q", api.IdentityRefKindSecret))
+		}
+	case api.IdentityRefKindClusterIdentity:
+		// cluster-scoped, namespace is not applicable
+	default:
+		allErrs = append(allErrs, fmt.Errorf("identityRef.kind must be %q or %q, got %q", api.IdentityRefKindSecret, api.IdentityRefKindClusterIdentity, ref.Kind))
+	}
+
+	if "" == ref.Name {
+		allErrs = append(allErrs, fmt.Errorf("identityRef.name is a required field"))
+	}
+
+	return allErrs
+}
+
+// validateFailureDomains checks that each entry of spec.FailureDomains
+// resolves at least a placement target, a datastore and a network, falling
+// back to the flat VsphereProviderSpec fields where an entry leaves an
+// override empty.
+func validateFailureDomains(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+
+	names := map[string]bool{}
+	for i, fd := range spec.FailureDomains {
+		if "" == fd.Name {
+			allErrs = append(allErrs, fmt.Errorf("failureDomains[%d].name is a required field", i))
+		} else if names[fd.Name] {
+			allErrs = append(allErrs, fmt.Errorf("failureDomains[%d].name %q is not unique", i, fd.Name))
+		} else {
+			names[fd.Name] = true
+		}
+
+		if "" == fd.RegionTagCategory || "" == fd.RegionTagName {
+			allErrs = append(allErrs, fmt.Errorf("failureDomains[%d] requires regionTagCategory and regionTagName", i))
+		}
+		if "" == fd.ZoneTagCategory || "" == fd.ZoneTagName {
+			allErrs = append(allErrs, fmt.Errorf("failureDomains[%d] requires zoneTagCategory and zoneTagName", i))
+		}
+
+		datastore := firstNonEmpty(fd.Datastore, fd.DatastoreCluster, spec.Datastore, spec.DatastoreCluster)
+		if "" == datastore {
+			allErrs = append(allErrs, fmt.Errorf("failureDomains[%d] resolves no datastore or datastoreCluster", i))
+		}
+		placement := firstNonEmpty(fd.ComputeCluster, fd.ResourcePool, fd.HostSystem, spec.ComputeCluster, spec.ResourcePool, spec.HostSystem)
+		if "" == placement {
+			allErrs = append(allErrs, fmt.Errorf("failureDomains[%d] resolves no computeCluster, resourcePool or hostSystem", i))
+		}
+		network := firstNonEmpty(fd.Network, spec.Network)
+		if "" == network {
+			allErrs = append(allErrs, fmt.Errorf("failureDomains[%d] resolves no network", i))
+		}
+	}
+
+	return allErrs
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func validateVCenters(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+	if len(spec.VCenters) == 0 {
+		return allErrs
+	}
+
+	names := map[string]bool{}
+	matchKeys := map[string]bool{}
+	for i, vc := range spec.VCenters {
+		if "" == vc.Name {
+			allErrs = append(allErrs, fmt.Errorf("vCenters[%d].name is a required field", i))
+		} else if names[vc.Name] {
+			allErrs = append(allErrs, fmt.Errorf("vCenters[%d].name %q is not unique", i, vc.Name))
+		} else {
+			names[vc.Name] = true
+		}
+		if "" == vc.Host {
+			allErrs = append(allErrs, fmt.Errorf("vCenters[%d].host is a required field", i))
+		}
+		matchKeys[vc.Name] = true
+		if vc.Region != "" {
+			matchKeys[vc.Region] = true
+		}
+	}
+
+	key := spec.VCenterName
+	if key == "" {
+		key = spec.Region
+	}
+	if key == "" {
+		allErrs = append(allErrs, fmt.Errorf("either vCenterName or region is required to select an entry of vCenters"))
+	} else if !matchKeys[key] {
+		allErrs = append(allErrs, fmt.Errorf("no vCenters entry matches vCenterName/region %q", key))
+	}
 
 	return allErrs
 }
@@ -69,16 +201,21 @@ func validateSpecTags(tags map[string]string) []error {
 	return allErrs
 }
 
-func validateSecrets(reference *api.Secrets) []error {
+// validateSecrets checks the inline vSphere credentials. requireCredentials
+// is false when VsphereProviderSpec.IdentityRef is set, in which case the
+// host/username/password are resolved from the referenced identity instead.
+func validateSecrets(reference *api.Secrets, requireCredentials bool) []error {
 	var allErrs []error
-	if "" == reference.VsphereHost {
-		allErrs = append(allErrs, fmt.Errorf("Secret vsphereHost is required field"))
-	}
-	if "" == reference.VsphereUsername {
-		allErrs = append(allErrs, fmt.Errorf("Secret vsphereUsername is required field"))
-	}
-	if "" == reference.VspherePassword {
-		allErrs = append(allErrs, fmt.Errorf("Secret vspherePassword is required field"))
+	if requireCredentials {
+		if "" == reference.VsphereHost {
+			allErrs = append(allErrs, fmt.Errorf("Secret vsphereHost is required field"))
+		}
+		if "" == reference.VsphereUsername {
+			allErrs = append(allErrs, fmt.Errorf("Secret vsphereUsername is required field"))
+		}
+		if "" == reference.VspherePassword {
+			allErrs = append(allErrs, fmt.Errorf("Secret vspherePassword is required field"))
+		}
 	}
 
 	if "" == reference.UserData {
@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vapi/cluster"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// clusterModuleFieldName is the custom field set on a VM recording the
+// Cluster Module it was added to, so DeleteMachine can remove and GC it
+// across restarts without an in-memory cache.
+const clusterModuleFieldName = "vsphere-provider.clusterModuleId"
+
+// addToClusterModule looks up or creates the vSphere Cluster Module keyed by
+// (computeCluster, groupKey) in datacenter, adds vm as a member, and records
+// the module ID on vm's clusterModuleFieldName custom field. datacenter is
+// the one computeCluster is looked up in; an empty datacenter falls back to
+// the vCenter's only/default datacenter.
+func addToClusterModule(ctx context.Context, client *govmomi.Client, username, password, datacenter, computeCluster, groupKey string, vm *object.VirtualMachine) error {
+	restClient := rest.NewClient(client.Client)
+	if err := restClient.Login(ctx, url.UserPassword(username, password)); err != nil {
+		return err
+	}
+	defer restClient.Logout(ctx)
+
+	clusterRef, err := findComputeCluster(ctx, client, datacenter, computeCluster)
+	if err != nil {
+		return err
+	}
+
+	moduleID, err := ensureClusterModule(ctx, client.Client, restClient, clusterRef, groupKey)
+	if err != nil {
+		return err
+	}
+
+	modules := cluster.NewManager(restClient)
+	if _, err := modules.AddModuleMembers(ctx, moduleID, vm.Reference()); err != nil {
+		return fmt.Errorf("adding %s to cluster module %s: %v", vm.Reference().Value, moduleID, err)
+	}
+
+	return setCustomFieldValue(ctx, client.Client, vm.Reference(), clusterModuleFieldName, "VirtualMachine", moduleID)
+}
+
+// removeFromClusterModule removes vm from the Cluster Module recorded in its
+// clusterModuleFieldName custom field, if any, and deletes the module once it
+// has no members left so restarts don't leak empty modules.
+func removeFromClusterModule(ctx context.Context, client *govmomi.Client, username, password string, vm *object.VirtualMachine) error {
+	moduleID, err := getCustomFieldValue(ctx, client.Client, vm.Reference(), clusterModuleFieldName)
+	if err != nil || moduleID == "" {
+		return err
+	}
+
+	restClient := rest.NewClient(client.Client)
+	if err := restClient.Login(ctx, url.UserPassword(username, password)); err != nil {
+		return err
+	}
+	defer restClient.Logout(ctx)
+
+	modules := cluster.NewManager(restClient)
+	if _, err := modules.RemoveModuleMembers(ctx, moduleID, vm.Reference()); err != nil {
+		return fmt.Errorf("removing %s from cluster module %s: %v", vm.Reference().Value, moduleID, err)
+	}
+
+	members, err := modules.ListModuleMembers(ctx, moduleID)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return modules.DeleteModule(ctx, moduleID)
+	}
+	return nil
+}
+
+// ensureClusterModule returns the ID of the Cluster Module for groupKey on
+// clusterRef, creating it and recording its ID on clusterRef's
+// clusterModuleFieldNameFor(groupKey) custom field if it doesn't exist yet.
+func ensureClusterModule(ctx context.Context, vimClient *vim25.Client, restClient *rest.Client, clusterRef *object.ClusterComputeResource, groupKey string) (string, error) {
+	fieldName := clusterModuleFieldNameFor(groupKey)
+	modules := cluster.NewManager(restClient)
+
+	moduleID, err := getCustomFieldValue(ctx, vimClient, clusterRef.Reference(), fieldName)
+	if err != nil {
+		return "", err
+	}
+	if moduleID != "" {
+		if summaries, err := modules.ListModules(ctx); err == nil {
+			for _, s := range summaries {
+				if s.Module == moduleID {
+					return moduleID, nil
+				}
+			}
+		}
+		// module was deleted out-of-band; fall through and recreate it
+	}
+
+	moduleID, err = modules.CreateModule(ctx, clusterRef.Reference())
+	if err != nil {
+		return "", fmt.Errorf("creating cluster module for group %q on cluster %q: %v", groupKey, clusterRef.Name(), err)
+	}
+
+	if err := setCustomFieldValue(ctx, vimClient, clusterRef.Reference(), fieldName, "ClusterComputeResource", moduleID); err != nil {
+		return "", err
+	}
+	return moduleID, nil
+}
+
+// clusterModuleFieldNameFor namespaces the custom field recording a cluster's
+// module ID by ClusterModuleGroup, since a DRS cluster can host more than one
+// anti-affinity group.
+func clusterModuleFieldNameFor(groupKey string) string {
+	return fmt.Sprintf("%s.%s", clusterModuleFieldName, groupKey)
+}
+
+// findComputeCluster resolves name against datacenter's host folder, the
+// same way the vcsim test harness and newClone resolve placement targets.
+// name is a bare cluster name (e.g. "DC0_C0"), not a full inventory path. An
+// empty datacenter falls back to the vCenter's only/default datacenter,
+// which errors if the vCenter has more than one.
+func findComputeCluster(ctx context.Context, client *govmomi.Client, datacenter, name string) (*object.ClusterComputeResource, error) {
+	finder := find.NewFinder(client.Client, true)
+
+	dc, err := resolveDatacenterObject(ctx, finder, datacenter)
+	if err != nil {
+		return nil, err
+	}
+	finder.SetDatacenter(dc)
+
+	clusterRef, err := finder.ClusterComputeResource(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("compute cluster %q not found: %v", name, err)
+	}
+	return clusterRef, nil
+}
+
+// resolveDatacenterObject looks up name via finder, or finder's default
+// datacenter if name is empty.
+func resolveDatacenterObject(ctx context.Context, finder *find.Finder, name string) (*object.Datacenter, error) {
+	if name != "" {
+		dc, err := finder.Datacenter(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("finding datacenter %q: %v", name, err)
+		}
+		return dc, nil
+	}
+
+	dc, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("finding default datacenter: %v", err)
+	}
+	return dc, nil
+}
+
+func getCustomFieldValue(ctx context.Context, vimClient *vim25.Client, ref types.ManagedObjectReference, fieldName string) (string, error) {
+	cfm, err := object.GetCustomFieldsManager(vimClient)
+	if err != nil {
+		return "", err
+	}
+	fields, err := cfm.Field(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var entity mo.ManagedEntity
+	if err := property.DefaultCollector(vimClient).RetrieveOne(ctx, ref, []string{"customValue"}, &entity); err != nil {
+		return "", err
+	}
+
+	for _, cv := range entity.CustomValue {
+		sv, ok := cv.(*types.CustomFieldStringValue)
+		if !ok {
+			continue
+		}
+		if fields.ByKey(sv.Key).Name == fieldName {
+			return sv.Value, nil
+		}
+	}
+	return "", nil
+}
+
+func setCustomFieldValue(ctx context.Context, vimClient *vim25.Client, ref types.ManagedObjectReference, fieldName, managedObjectType, value string) error {
+	cfm, err := object.GetCustomFieldsManager(vimClient)
+	if err != nil {
+		return err
+	}
+
+	fields, err := cfm.Field(ctx)
+	if err != nil {
+		return err
+	}
+	var key int32
+	for _, f := range fields {
+		if f.Name == fieldName {
+			key = f.Key
+			break
+		}
+	}
+	if key == 0 {
+		def, err := cfm.Add(ctx, fieldName, managedObjectType, nil, nil)
+		if err != nil {
+			return err
+		}
+		key = def.Key
+	}
+
+	return cfm.Set(ctx, ref, key, value)
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// selectFailureDomain picks the FailureDomains entry CreateMachine should
+// place machineName into. A providerSpec.Tags[api.FailureDomainTag] pins it
+// to a specific entry; otherwise rrIndex (an ever-increasing counter)
+// distributes machines round-robin across FailureDomains. It returns nil, nil
+// if providerSpec.FailureDomains is empty.
+func selectFailureDomain(providerSpec *api.VsphereProviderSpec, rrIndex uint64) (*api.FailureDomain, error) {
+	if len(providerSpec.FailureDomains) == 0 {
+		return nil, nil
+	}
+
+	if name := providerSpec.Tags[api.FailureDomainTag]; name != "" {
+		for i := range providerSpec.FailureDomains {
+			if providerSpec.FailureDomains[i].Name == name {
+				return &providerSpec.FailureDomains[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no failureDomains entry named %q", name)
+	}
+
+	idx := int(rrIndex % uint64(len(providerSpec.FailureDomains)))
+	return &providerSpec.FailureDomains[idx], nil
+}
+
+// withFailureDomain returns a copy of providerSpec with the placement fields
+// overridden by fd where fd sets them, leaving providerSpec untouched. A nil
+// fd returns providerSpec unchanged.
+func withFailureDomain(providerSpec *api.VsphereProviderSpec, fd *api.FailureDomain) *api.VsphereProviderSpec {
+	if fd == nil {
+		return providerSpec
+	}
+
+	spec := *providerSpec
+	if fd.ComputeCluster != "" {
+		spec.ComputeCluster = fd.ComputeCluster
+	}
+	if fd.ResourcePool != "" {
+		spec.ResourcePool = fd.ResourcePool
+	}
+	if fd.HostSystem != "" {
+		spec.HostSystem = fd.HostSystem
+	}
+	if fd.Datastore != "" {
+		spec.Datastore = fd.Datastore
+	}
+	if fd.DatastoreCluster != "" {
+		spec.DatastoreCluster = fd.DatastoreCluster
+	}
+	if fd.Network != "" {
+		spec.Network = fd.Network
+	}
+	return &spec
+}
+
+// zoneTagMatcher tells whether a VM runs in one of providerSpec.FailureDomains,
+// by the region/zone vSphere tags attached to its runtime host and that
+// host's compute cluster — mirroring how the in-tree vSphere cloud provider
+// and CAPV tag the inventory, not the VM itself. It is used by ListMachines
+// to narrow down discovered VMs to one of the configured failure domains, in
+// addition to the existing cluster/role custom field matching.
+type zoneTagMatcher struct {
+	vimClient  *vim25.Client
+	restClient *rest.Client
+	tags       *tags.Manager
+
+	// categoryNames caches tag category ID to name lookups across Matches
+	// calls, since GetAttachedTags only returns a tag's CategoryID.
+	categoryNames map[string]string
+}
+
+// newZoneTagMatcher logs in a CIS REST session alongside the given vim25
+// client to query vSphere tags. It returns ok=false without error when
+// providerSpec declares no FailureDomains, since no REST session is needed.
+func newZoneTagMatcher(ctx context.Context, client *govmomi.Client, providerSpec *api.VsphereProviderSpec, username, password string) (*zoneTagMatcher, bool, error) {
+	if len(providerSpec.FailureDomains) == 0 {
+		return nil, false, nil
+	}
+
+	restClient := rest.NewClient(client.Client)
+	if err := restClient.Login(ctx, url.UserPassword(username, password)); err != nil {
+		return nil, false, err
+	}
+
+	return &zoneTagMatcher{
+		vimClient:     client.Client,
+		restClient:    restClient,
+		tags:          tags.NewManager(restClient),
+		categoryNames: map[string]string{},
+	}, true, nil
+}
+
+func (m *zoneTagMatcher) Close(ctx context.Context) {
+	m.restClient.Logout(ctx)
+}
+
+// categoryName resolves a tag category ID to its name, caching the result
+// since the same categories are looked up for every ref Matches is called on.
+func (m *zoneTagMatcher) categoryName(ctx context.Context, categoryID string) (string, error) {
+	if name, ok := m.categoryNames[categoryID]; ok {
+		return name, nil
+	}
+	category, err := m.tags.GetCategory(ctx, categoryID)
+	if err != nil {
+		return "", err
+	}
+	m.categoryNames[categoryID] = category.Name
+	return category.Name, nil
+}
+
+// attachedTagsByCategory returns the names of the tags attached to ref,
+// keyed by their category name, since tag names are only unique within
+// their category.
+func (m *zoneTagMatcher) attachedTagsByCategory(ctx context.Context, ref object.Reference) (map[string][]string, error) {
+	attached, err := m.tags.GetAttachedTags(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	byCategory := map[string][]string{}
+	for _, tag := range attached {
+		categoryName, err := m.categoryName(ctx, tag.CategoryID)
+		if err != nil {
+			return nil, err
+		}
+		byCategory[categoryName] = append(byCategory[categoryName], tag.Name)
+	}
+	return byCategory, nil
+}
+
+func hasTag(byCategory map[string][]string, category, name string) bool {
+	for _, n := range byCategory[category] {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether vm runs on a host/cluster carrying the region+zone
+// tag pair of any configured FailureDomain: the region tag on the host's
+// compute cluster, the zone tag on the host itself.
+func (m *zoneTagMatcher) Matches(ctx context.Context, vm *object.VirtualMachine, failureDomains []api.FailureDomain) (bool, error) {
+	host, err := vm.HostSystem(ctx)
+	if err != nil {
+		return false, err
+	}
+	if host == nil {
+		return false, nil
+	}
+
+	var hostEntity mo.HostSystem
+	if err := property.DefaultCollector(m.vimClient).RetrieveOne(ctx, host.Reference(), []string{"parent"}, &hostEntity); err != nil {
+		return false, err
+	}
+
+	hostTags, err := m.attachedTagsByCategory(ctx, host.Reference())
+	if err != nil {
+		return false, err
+	}
+	var clusterTags map[string][]string
+	if hostEntity.Parent != nil {
+		clusterTags, err = m.attachedTagsByCategory(ctx, object.NewCommon(m.vimClient, *hostEntity.Parent))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, fd := range failureDomains {
+		if hasTag(clusterTags, fd.RegionTagCategory, fd.RegionTagName) && hasTag(hostTags, fd.ZoneTagCategory, fd.ZoneTagName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
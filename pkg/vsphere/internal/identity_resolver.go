@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+// StaticIdentityResolver is an IdentityResolver backed by an in-memory table
+// of VSphereClusterIdentity entries, for embedders that keep cluster
+// identities in their own config rather than as live Kubernetes objects. It
+// only resolves IdentityRefKindClusterIdentity; IdentityRefKindSecret has no
+// object for this package to read without a Kubernetes client, so it is
+// rejected here and left to a resolver supplied by the embedding controller.
+type StaticIdentityResolver struct {
+	// Identities maps VSphereClusterIdentity.Name to the identity it
+	// describes.
+	Identities map[string]StaticIdentity
+
+	// NamespaceLabels returns the labels of namespace, consulted when an
+	// identity's AllowedNamespaces sets Selector. It may be nil if no
+	// configured identity uses Selector.
+	NamespaceLabels func(namespace string) (map[string]string, error)
+}
+
+// StaticIdentity pairs the vSphere credentials a VSphereClusterIdentity
+// resolves to with the namespaces allowed to reference it.
+type StaticIdentity struct {
+	Secrets           api.Secrets
+	AllowedNamespaces *api.AllowedNamespaces
+}
+
+// ResolveIdentity implements IdentityResolver.
+func (r *StaticIdentityResolver) ResolveIdentity(ctx context.Context, ref *api.IdentityRef, namespace string) (*api.Secrets, error) {
+	if ref.Kind != api.IdentityRefKindClusterIdentity {
+		return nil, fmt.Errorf("StaticIdentityResolver only resolves identityRef kind %q, got %q", api.IdentityRefKindClusterIdentity, ref.Kind)
+	}
+
+	identity, ok := r.Identities[ref.Name]
+	if !ok {
+		return nil, fmt.Errorf("no VSphereClusterIdentity named %q", ref.Name)
+	}
+
+	allowed, err := r.namespaceAllowed(identity.AllowedNamespaces, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, fmt.Errorf("namespace %q is not allowed to use VSphereClusterIdentity %q", namespace, ref.Name)
+	}
+
+	secrets := identity.Secrets
+	return &secrets, nil
+}
+
+// namespaceAllowed reports whether namespace may use an identity restricted
+// by allowed. A nil allowed allows no namespace, per AllowedNamespaces's doc
+// comment.
+func (r *StaticIdentityResolver) namespaceAllowed(allowed *api.AllowedNamespaces, namespace string) (bool, error) {
+	if allowed == nil {
+		return false, nil
+	}
+
+	for _, n := range allowed.NamespaceList {
+		if n == namespace {
+			return true, nil
+		}
+	}
+
+	if len(allowed.Selector) == 0 {
+		return false, nil
+	}
+	if r.NamespaceLabels == nil {
+		return false, fmt.Errorf("VSphereClusterIdentity restricts allowedNamespaces.selector but no NamespaceLabels lookup is configured")
+	}
+
+	labels, err := r.NamespaceLabels(namespace)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range allowed.Selector {
+		if labels[k] != v {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestStaticIdentityResolverNamespaceList(t *testing.T) {
+	resolver := &StaticIdentityResolver{
+		Identities: map[string]StaticIdentity{
+			"shared": {
+				Secrets:           api.Secrets{VsphereHost: "vc.example.com", VsphereUsername: "user", VspherePassword: "pass"},
+				AllowedNamespaces: &api.AllowedNamespaces{NamespaceList: []string{"team-a"}},
+			},
+		},
+	}
+	ref := &api.IdentityRef{Kind: api.IdentityRefKindClusterIdentity, Name: "shared"}
+
+	secrets, err := resolver.ResolveIdentity(context.Background(), ref, "team-a")
+	if err != nil {
+		t.Fatalf("expected team-a to be allowed, got error: %v", err)
+	}
+	if secrets.VsphereHost != "vc.example.com" {
+		t.Errorf("expected resolved host %q, got %q", "vc.example.com", secrets.VsphereHost)
+	}
+
+	if _, err := resolver.ResolveIdentity(context.Background(), ref, "team-b"); err == nil {
+		t.Fatal("expected team-b to be denied, got no error")
+	}
+}
+
+func TestStaticIdentityResolverSelector(t *testing.T) {
+	resolver := &StaticIdentityResolver{
+		Identities: map[string]StaticIdentity{
+			"shared": {
+				Secrets:           api.Secrets{VsphereHost: "vc.example.com"},
+				AllowedNamespaces: &api.AllowedNamespaces{Selector: map[string]string{"team": "a"}},
+			},
+		},
+		NamespaceLabels: func(namespace string) (map[string]string, error) {
+			if namespace == "team-a-ns" {
+				return map[string]string{"team": "a"}, nil
+			}
+			return map[string]string{"team": "b"}, nil
+		},
+	}
+	ref := &api.IdentityRef{Kind: api.IdentityRefKindClusterIdentity, Name: "shared"}
+
+	if _, err := resolver.ResolveIdentity(context.Background(), ref, "team-a-ns"); err != nil {
+		t.Fatalf("expected team-a-ns to be allowed by selector, got error: %v", err)
+	}
+	if _, err := resolver.ResolveIdentity(context.Background(), ref, "team-b-ns"); err == nil {
+		t.Fatal("expected team-b-ns to be denied by selector, got no error")
+	}
+}
+
+func TestStaticIdentityResolverNilAllowedNamespacesDeniesAll(t *testing.T) {
+	resolver := &StaticIdentityResolver{
+		Identities: map[string]StaticIdentity{
+			"locked-down": {Secrets: api.Secrets{VsphereHost: "vc.example.com"}},
+		},
+	}
+	ref := &api.IdentityRef{Kind: api.IdentityRefKindClusterIdentity, Name: "locked-down"}
+
+	if _, err := resolver.ResolveIdentity(context.Background(), ref, "any-namespace"); err == nil {
+		t.Fatal("expected a nil AllowedNamespaces to deny all namespaces, got no error")
+	}
+}
+
+func TestStaticIdentityResolverRejectsSecretKind(t *testing.T) {
+	resolver := &StaticIdentityResolver{}
+	ref := &api.IdentityRef{Kind: api.IdentityRefKindSecret, Name: "some-secret", Namespace: "team-a"}
+
+	if _, err := resolver.ResolveIdentity(context.Background(), ref, "team-a"); err == nil {
+		t.Fatal("expected StaticIdentityResolver to reject a Secret-kind identityRef, got no error")
+	}
+}
@@ -20,8 +20,8 @@ package internal
 import (
 	"context"
 	"fmt"
-	"net/url"
 	"strings"
+	"sync/atomic"
 
 	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
 	"github.com/vmware/govmomi"
@@ -30,38 +30,143 @@ import (
 	"github.com/vmware/govmomi/vim25/types"
 )
 
+// IdentityResolver resolves a VsphereProviderSpec.IdentityRef into the
+// vSphere credentials it points at, e.g. by reading a Secret or a
+// cluster-scoped identity object from the Kubernetes API. It is supplied by
+// the embedding controller, which has access to a Kubernetes client; this
+// package has none.
+type IdentityResolver interface {
+	// ResolveIdentity resolves ref and validates that namespace is allowed to
+	// use it (e.g. for a cluster-scoped identity shared across namespaces,
+	// against its own allow-list of namespaces).
+	ResolveIdentity(ctx context.Context, ref *api.IdentityRef, namespace string) (*api.Secrets, error)
+}
+
 // PluginSPIImpl is the real implementation of PluginSPI interface
 // that makes the calls to the provider SDK
-type PluginSPIImpl struct{}
+type PluginSPIImpl struct {
+	// IdentityResolver resolves VsphereProviderSpec.IdentityRef. It may be
+	// nil if no MachineClass in the landscape uses IdentityRef.
+	IdentityResolver IdentityResolver
+	// SessionCache caches logged-in govmomi clients across calls. It is
+	// created lazily with default settings if left nil.
+	SessionCache SessionCache
+
+	// failureDomainRoundRobin distributes machines across
+	// VsphereProviderSpec.FailureDomains when no explicit FailureDomainTag
+	// is set. Accessed with sync/atomic.
+	failureDomainRoundRobin uint64
+}
 
 const providerPrefix = "vsphere://"
 
+func (spi *PluginSPIImpl) sessionCache() SessionCache {
+	if spi.SessionCache == nil {
+		spi.SessionCache = NewSessionCache(0)
+	}
+	return spi.SessionCache
+}
+
+// Close logs out all sessions held by the session cache. Call it on process
+// shutdown so vCenter doesn't carry stale sessions until they time out.
+func (spi *PluginSPIImpl) Close(ctx context.Context) {
+	if spi.SessionCache != nil {
+		spi.SessionCache.Close(ctx)
+	}
+}
+
+// withClient obtains a cached, logged-in client for providerSpec/secrets and
+// runs fn with it. If fn fails with a session-expired error, the cached
+// session is evicted and fn is retried once against a freshly logged-in
+// client.
+func (spi *PluginSPIImpl) withClient(ctx context.Context, providerSpec *api.VsphereProviderSpec, secrets *api.Secrets, vcenterKey string, fn func(*govmomi.Client) error) error {
+	host, username, password, insecureSSL := resolveConnection(providerSpec, secrets, vcenterKey)
+	cache := spi.sessionCache()
+
+	client, err := cache.Get(ctx, host, username, password, insecureSSL)
+	if err != nil {
+		return err
+	}
+
+	err = fn(client)
+	if err != nil && isNotAuthenticatedError(err) {
+		cache.Evict(ctx, host, username, insecureSSL)
+		client, err = cache.Get(ctx, host, username, password, insecureSSL)
+		if err != nil {
+			return err
+		}
+		err = fn(client)
+	}
+	return err
+}
+
+// resolveSecrets returns secrets unchanged unless providerSpec.IdentityRef is
+// set, in which case the referenced identity is resolved via
+// spi.IdentityResolver and used instead of the inline credentials.
+func (spi *PluginSPIImpl) resolveSecrets(ctx context.Context, providerSpec *api.VsphereProviderSpec, secrets *api.Secrets) (*api.Secrets, error) {
+	if providerSpec.IdentityRef == nil {
+		return secrets, nil
+	}
+	if spi.IdentityResolver == nil {
+		return nil, fmt.Errorf("providerSpec.identityRef is set but no IdentityResolver is configured")
+	}
+	resolved, err := spi.IdentityResolver.ResolveIdentity(ctx, providerSpec.IdentityRef, secrets.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("resolving identityRef %s/%s: %v", providerSpec.IdentityRef.Kind, providerSpec.IdentityRef.Name, err)
+	}
+	resolved.UserData = secrets.UserData
+	return resolved, nil
+}
+
 // CreateMachine creates a VM by cloning from a template
 func (spi *PluginSPIImpl) CreateMachine(ctx context.Context, machineName string, providerSpec *api.VsphereProviderSpec, secrets *api.Secrets) (string, error) {
-	client, err := createVsphereClient(ctx, secrets)
+	secrets, err := spi.resolveSecrets(ctx, providerSpec, secrets)
 	if err != nil {
 		return "", err
 	}
-	defer client.Logout(ctx)
 
-	cmd := newClone(machineName, providerSpec, secrets.UserData)
-	err = cmd.Run(ctx, client)
+	fd, err := selectFailureDomain(providerSpec, atomic.AddUint64(&spi.failureDomainRoundRobin, 1))
 	if err != nil {
 		return "", err
 	}
-	machineID := cmd.Clone.UUID(ctx)
-	providerID := spi.encodeProviderID(providerSpec.Region, machineID)
+	effectiveSpec := withFailureDomain(providerSpec, fd)
+
+	vcenterKey := vcenterKeyOf(providerSpec, "")
+	var machineID string
+	err = spi.withClient(ctx, effectiveSpec, secrets, vcenterKey, func(client *govmomi.Client) error {
+		cmd := newClone(machineName, effectiveSpec, secrets.UserData)
+		if err := cmd.Run(ctx, client); err != nil {
+			return err
+		}
+		machineID = cmd.Clone.UUID(ctx)
+
+		if effectiveSpec.ClusterModuleGroup != "" {
+			_, username, password, _ := resolveConnection(effectiveSpec, secrets, vcenterKey)
+			datacenter := resolveDatacenter(effectiveSpec, vcenterKey)
+			if err := addToClusterModule(ctx, client, username, password, datacenter, effectiveSpec.ComputeCluster, effectiveSpec.ClusterModuleGroup, cmd.Clone); err != nil {
+				return fmt.Errorf("adding %s to cluster module group %q: %v", machineName, effectiveSpec.ClusterModuleGroup, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	providerID := spi.encodeProviderID(vcenterKey, machineID)
 	return providerID, nil
 }
 
-func (spi *PluginSPIImpl) encodeProviderID(region, machineID string) string {
+// encodeProviderID embeds the vCenter the machine was created on (region, or
+// VCenterName when VCenters is used) so that later calls can resolve the
+// same vCenter without depending on the MachineClass still pointing at it.
+func (spi *PluginSPIImpl) encodeProviderID(vcenterKey, machineID string) string {
 	if machineID == "" {
 		return ""
 	}
-	return fmt.Sprintf("%s%s/%s", providerPrefix, region, machineID)
+	return fmt.Sprintf("%s%s/%s", providerPrefix, vcenterKey, machineID)
 }
 
-func (spi *PluginSPIImpl) decodeProviderID(providerID string) (region, machineID string) {
+func (spi *PluginSPIImpl) decodeProviderID(providerID string) (vcenterKey, machineID string) {
 	if !strings.HasPrefix(providerID, providerPrefix) {
 		return
 	}
@@ -69,75 +174,97 @@ func (spi *PluginSPIImpl) decodeProviderID(providerID string) (region, machineID
 	if len(parts) != 2 {
 		return
 	}
-	region = parts[0]
+	vcenterKey = parts[0]
 	machineID = parts[1]
 	return
 }
 
 // DeleteMachine deletes a VM by name
 func (spi *PluginSPIImpl) DeleteMachine(ctx context.Context, machineName string, providerID string, providerSpec *api.VsphereProviderSpec, secrets *api.Secrets) (string, error) {
-	client, err := createVsphereClient(ctx, secrets)
+	secrets, err := spi.resolveSecrets(ctx, providerSpec, secrets)
 	if err != nil {
 		return "", err
 	}
-	defer client.Logout(ctx)
 
-	_, machineID := spi.decodeProviderID(providerID)
-	foundMachineID, err := deleteVM(ctx, client, providerSpec, machineName, machineID)
+	vcenterKey, machineID := spi.decodeProviderID(providerID)
+	var foundMachineID string
+	err = spi.withClient(ctx, providerSpec, secrets, vcenterKey, func(client *govmomi.Client) error {
+		if providerSpec.ClusterModuleGroup != "" {
+			if vm, err := findVM(ctx, client, providerSpec, machineName, machineID); err == nil {
+				_, username, password, _ := resolveConnection(providerSpec, secrets, vcenterKey)
+				if err := removeFromClusterModule(ctx, client, username, password, vm); err != nil {
+					return fmt.Errorf("removing %s from cluster module group %q: %v", machineName, providerSpec.ClusterModuleGroup, err)
+				}
+			}
+		}
+
+		var err error
+		foundMachineID, err = deleteVM(ctx, client, providerSpec, machineName, machineID)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 
-	foundProviderID := spi.encodeProviderID(providerSpec.Region, foundMachineID)
+	foundProviderID := spi.encodeProviderID(vcenterKey, foundMachineID)
 	return foundProviderID, nil
 }
 
 // ShutDownMachine shuts down a machine by name
 func (spi *PluginSPIImpl) ShutDownMachine(ctx context.Context, machineName string, providerID string, providerSpec *api.VsphereProviderSpec, secrets *api.Secrets) (string, error) {
-	client, err := createVsphereClient(ctx, secrets)
+	secrets, err := spi.resolveSecrets(ctx, providerSpec, secrets)
 	if err != nil {
 		return "", err
 	}
-	defer client.Logout(ctx)
 
-	_, machineID := spi.decodeProviderID(providerID)
-	foundMachineID, err := shutDownVM(ctx, client, providerSpec, machineName, machineID)
+	vcenterKey, machineID := spi.decodeProviderID(providerID)
+	var foundMachineID string
+	err = spi.withClient(ctx, providerSpec, secrets, vcenterKey, func(client *govmomi.Client) error {
+		var err error
+		foundMachineID, err = shutDownVM(ctx, client, providerSpec, machineName, machineID)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 
-	foundProviderID := spi.encodeProviderID(providerSpec.Region, foundMachineID)
+	foundProviderID := spi.encodeProviderID(vcenterKey, foundMachineID)
 	return foundProviderID, nil
 }
 
 // GetMachineStatus checks for existence of VM by name
 func (spi *PluginSPIImpl) GetMachineStatus(ctx context.Context, machineName string, providerID string, providerSpec *api.VsphereProviderSpec, secrets *api.Secrets) (string, error) {
-	client, err := createVsphereClient(ctx, secrets)
+	secrets, err := spi.resolveSecrets(ctx, providerSpec, secrets)
 	if err != nil {
 		return "", err
 	}
-	defer client.Logout(ctx)
 
-	_, machineID := spi.decodeProviderID(providerID)
-	vm, err := findVM(ctx, client, providerSpec, machineName, machineID)
+	vcenterKey, machineID := spi.decodeProviderID(providerID)
+	var foundMachineID string
+	err = spi.withClient(ctx, providerSpec, secrets, vcenterKey, func(client *govmomi.Client) error {
+		vm, err := findVM(ctx, client, providerSpec, machineName, machineID)
+		if err != nil {
+			return err
+		}
+		foundMachineID = vm.UUID(ctx)
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
 
-	foundMachineID := vm.UUID(ctx)
-
-	foundProviderID := spi.encodeProviderID(providerSpec.Region, foundMachineID)
+	foundProviderID := spi.encodeProviderID(vcenterKey, foundMachineID)
 	return foundProviderID, nil
 }
 
 // ListMachines lists all VMs in the DC or folder
 func (spi *PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.VsphereProviderSpec, secrets *api.Secrets) (map[string]string, error) {
-	client, err := createVsphereClient(ctx, secrets)
+	secrets, err := spi.resolveSecrets(ctx, providerSpec, secrets)
 	if err != nil {
 		return nil, err
 	}
-	defer client.Logout(ctx)
 
+	vcenterKey := vcenterKeyOf(providerSpec, "")
 	machineList := map[string]string{}
 
 	clusterName := ""
@@ -154,27 +281,54 @@ func (spi *PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.Vs
 		return machineList, nil
 	}
 
-	visitor := func(vm *object.VirtualMachine, obj mo.ManagedEntity, field object.CustomFieldDefList) error {
-		matchedCluster := false
-		matchedRole := false
-		for _, cv := range obj.CustomValue {
-			sv := cv.(*types.CustomFieldStringValue)
-			switch field.ByKey(sv.Key).Name {
-			case clusterName:
-				matchedCluster = true
-			case nodeRole:
-				matchedRole = true
+	err = spi.withClient(ctx, providerSpec, secrets, vcenterKey, func(client *govmomi.Client) error {
+		var zoneMatcher *zoneTagMatcher
+		if len(providerSpec.FailureDomains) > 0 {
+			_, username, password, _ := resolveConnection(providerSpec, secrets, vcenterKey)
+			matcher, ok, err := newZoneTagMatcher(ctx, client, providerSpec, username, password)
+			if err != nil {
+				return err
+			}
+			if ok {
+				zoneMatcher = matcher
+				defer zoneMatcher.Close(ctx)
 			}
 		}
-		if matchedCluster && matchedRole {
+
+		visitor := func(vm *object.VirtualMachine, obj mo.ManagedEntity, field object.CustomFieldDefList) error {
+			matchedCluster := false
+			matchedRole := false
+			for _, cv := range obj.CustomValue {
+				sv := cv.(*types.CustomFieldStringValue)
+				switch field.ByKey(sv.Key).Name {
+				case clusterName:
+					matchedCluster = true
+				case nodeRole:
+					matchedRole = true
+				}
+			}
+
+			if !matchedCluster || !matchedRole {
+				return nil
+			}
+			if zoneMatcher != nil {
+				matchedZone, err := zoneMatcher.Matches(ctx, vm, providerSpec.FailureDomains)
+				if err != nil {
+					return err
+				}
+				if !matchedZone {
+					return nil
+				}
+			}
+
 			uuid := vm.UUID(ctx)
-			providerID := spi.encodeProviderID(providerSpec.Region, uuid)
+			providerID := spi.encodeProviderID(vcenterKey, uuid)
 			machineList[providerID] = obj.Name
+			return nil
 		}
-		return nil
-	}
 
-	err = visitVirtualMachines(ctx, client, providerSpec, visitor)
+		return visitVirtualMachines(ctx, client, providerSpec, visitor)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -182,14 +336,69 @@ func (spi *PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.Vs
 	return machineList, nil
 }
 
-func createVsphereClient(ctx context.Context, secret *api.Secrets) (*govmomi.Client, error) {
-	clientURL, err := url.Parse("https://" + secret.VsphereHost + "/sdk")
-	if err != nil {
-		return nil, err
+// vcenterKeyOf returns the identifier to embed in a provider ID for the
+// vCenter a machine lives on: the matching VCenterConfig.Name/Region when
+// providerSpec.VCenters is used, or providerSpec.Region for the legacy
+// single-vCenter setup. If key is non-empty it is returned as-is, so that
+// List/Get/Delete can keep targeting the vCenter a machine was actually
+// created on instead of the MachineClass's current default.
+func vcenterKeyOf(providerSpec *api.VsphereProviderSpec, key string) string {
+	if key != "" {
+		return key
 	}
+	if providerSpec.VCenterName != "" {
+		return providerSpec.VCenterName
+	}
+	return providerSpec.Region
+}
 
-	clientURL.User = url.UserPassword(secret.VsphereUsername, secret.VspherePassword)
+// resolveVCenter looks up the VCenterConfig matching key among
+// providerSpec.VCenters. It returns ok=false when providerSpec.VCenters is
+// empty, in which case the caller should fall back to the legacy
+// single-vCenter fields of Secrets.
+func resolveVCenter(providerSpec *api.VsphereProviderSpec, key string) (vcenter api.VCenterConfig, ok bool) {
+	if len(providerSpec.VCenters) == 0 {
+		return api.VCenterConfig{}, false
+	}
+	for _, vc := range providerSpec.VCenters {
+		if vc.Name == key || (vc.Region != "" && vc.Region == key) {
+			return vc, true
+		}
+	}
+	return api.VCenterConfig{}, false
+}
 
-	// Connect and log in to ESX or vCenter
-	return govmomi.NewClient(ctx, clientURL, secret.VsphereInsecureSSL)
+// resolveConnection resolves the host/username/password/insecureSSL to
+// connect with, either from the legacy single-vCenter fields of secret or,
+// when providerSpec.VCenters is used, from the VCenterConfig matching
+// vcenterKey.
+func resolveConnection(providerSpec *api.VsphereProviderSpec, secret *api.Secrets, vcenterKey string) (host, username, password string, insecureSSL bool) {
+	host = secret.VsphereHost
+	username = secret.VsphereUsername
+	password = secret.VspherePassword
+	insecureSSL = secret.VsphereInsecureSSL
+
+	if vcenter, ok := resolveVCenter(providerSpec, vcenterKeyOf(providerSpec, vcenterKey)); ok {
+		host = vcenter.Host
+		insecureSSL = vcenter.InsecureSSL
+		if vcenter.UsernameSecretKey != "" {
+			username = secret.VCenterCredentials[vcenter.UsernameSecretKey]
+		}
+		if vcenter.PasswordSecretKey != "" {
+			password = secret.VCenterCredentials[vcenter.PasswordSecretKey]
+		}
+	}
+	return host, username, password, insecureSSL
+}
+
+// resolveDatacenter returns the name of the datacenter that cluster-module
+// lookups (via findComputeCluster) target: VCenterConfig.Datacenter when
+// providerSpec.VCenters is used and the matching entry sets it, or "" to fall
+// back to the vCenter's only/default datacenter for the legacy single-vCenter
+// setup. newClone is not given this datacenter.
+func resolveDatacenter(providerSpec *api.VsphereProviderSpec, vcenterKey string) string {
+	if vcenter, ok := resolveVCenter(providerSpec, vcenterKeyOf(providerSpec, vcenterKey)); ok {
+		return vcenter.Datacenter
+	}
+	return ""
 }
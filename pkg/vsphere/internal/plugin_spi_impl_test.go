@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	vsphereTesting "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/testing"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+)
+
+func TestEncodeDecodeProviderIDRoundTrip(t *testing.T) {
+	spi := &PluginSPIImpl{}
+
+	providerID := spi.encodeProviderID("eu-de-1", "423f242d-1f1f-4f1f-9f9f-1234567890ab")
+	vcenterKey, machineID := spi.decodeProviderID(providerID)
+
+	if vcenterKey != "eu-de-1" {
+		t.Errorf("expected vcenterKey %q, got %q", "eu-de-1", vcenterKey)
+	}
+	if machineID != "423f242d-1f1f-4f1f-9f9f-1234567890ab" {
+		t.Errorf("expected machineID %q, got %q", "423f242d-1f1f-4f1f-9f9f-1234567890ab", machineID)
+	}
+}
+
+func TestResolveVCenterByRegion(t *testing.T) {
+	spec := &api.VsphereProviderSpec{
+		Region: "eu-de-1",
+		VCenters: []api.VCenterConfig{
+			{Name: "vc-a", Host: "vc-a.example.com", Region: "eu-de-1"},
+			{Name: "vc-b", Host: "vc-b.example.com", Region: "eu-de-2"},
+		},
+	}
+
+	vcenter, ok := resolveVCenter(spec, vcenterKeyOf(spec, ""))
+	if !ok {
+		t.Fatal("expected resolveVCenter to find an entry by region")
+	}
+	if vcenter.Name != "vc-a" {
+		t.Errorf("expected vc-a, got %q", vcenter.Name)
+	}
+}
+
+func TestResolveDatacenter(t *testing.T) {
+	spec := &api.VsphereProviderSpec{
+		Region: "eu-de-1",
+		VCenters: []api.VCenterConfig{
+			{Name: "vc-a", Host: "vc-a.example.com", Region: "eu-de-1", Datacenter: "DC-A"},
+			{Name: "vc-b", Host: "vc-b.example.com", Region: "eu-de-2"},
+		},
+	}
+
+	if dc := resolveDatacenter(spec, vcenterKeyOf(spec, "")); dc != "DC-A" {
+		t.Errorf("expected datacenter %q, got %q", "DC-A", dc)
+	}
+
+	legacySpec := &api.VsphereProviderSpec{}
+	if dc := resolveDatacenter(legacySpec, vcenterKeyOf(legacySpec, "")); dc != "" {
+		t.Errorf("expected no datacenter override for the legacy single-vCenter setup, got %q", dc)
+	}
+}
+
+func TestCreateListGetShutDownDeleteMachine(t *testing.T) {
+	env := vsphereTesting.NewEnvironment(t)
+	ctx := context.Background()
+	spi := &PluginSPIImpl{}
+
+	spec := env.Spec
+	spec.Tags = map[string]string{
+		"kubernetes.io/cluster/shoot--test--local": "1",
+		"kubernetes.io/role/worker":                "1",
+	}
+
+	providerID, err := spi.CreateMachine(ctx, "test-machine-0", spec, env.Secrets)
+	if err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+	if providerID == "" {
+		t.Fatal("expected a non-empty providerID")
+	}
+
+	if vcenterKey, _ := spi.decodeProviderID(providerID); vcenterKey != spec.Region {
+		t.Errorf("expected providerID to embed region %q, got %q", spec.Region, vcenterKey)
+	}
+
+	machines, err := spi.ListMachines(ctx, spec, env.Secrets)
+	if err != nil {
+		t.Fatalf("ListMachines failed: %v", err)
+	}
+	if _, ok := machines[providerID]; !ok {
+		t.Fatalf("expected ListMachines to report %q, got %v", providerID, machines)
+	}
+
+	if status, err := spi.GetMachineStatus(ctx, "test-machine-0", providerID, spec, env.Secrets); err != nil {
+		t.Fatalf("GetMachineStatus failed: %v", err)
+	} else if status != providerID {
+		t.Errorf("expected GetMachineStatus to return %q, got %q", providerID, status)
+	}
+
+	if _, err := spi.ShutDownMachine(ctx, "test-machine-0", providerID, spec, env.Secrets); err != nil {
+		t.Fatalf("ShutDownMachine failed: %v", err)
+	}
+
+	if _, err := spi.DeleteMachine(ctx, "test-machine-0", providerID, spec, env.Secrets); err != nil {
+		t.Fatalf("DeleteMachine failed: %v", err)
+	}
+
+	machines, err = spi.ListMachines(ctx, spec, env.Secrets)
+	if err != nil {
+		t.Fatalf("ListMachines after delete failed: %v", err)
+	}
+	if _, ok := machines[providerID]; ok {
+		t.Fatalf("expected %q to be gone after DeleteMachine, got %v", providerID, machines)
+	}
+}
+
+// TestCreateMachineWithClusterModule exercises the ClusterModuleGroup path of
+// CreateMachine/DeleteMachine. addToClusterModule resolves spec.ComputeCluster
+// as a bare name; removeFromClusterModule finds the module via the VM's
+// custom field.
+func TestCreateMachineWithClusterModule(t *testing.T) {
+	env := vsphereTesting.NewEnvironment(t)
+	ctx := context.Background()
+	spi := &PluginSPIImpl{}
+
+	spec := env.Spec
+	spec.Tags = map[string]string{
+		"kubernetes.io/cluster/shoot--test--local": "1",
+		"kubernetes.io/role/worker":                "1",
+	}
+	spec.ClusterModuleGroup = "workers"
+
+	providerID, err := spi.CreateMachine(ctx, "test-machine-1", spec, env.Secrets)
+	if err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+
+	if _, err := spi.DeleteMachine(ctx, "test-machine-1", providerID, spec, env.Secrets); err != nil {
+		t.Fatalf("DeleteMachine failed: %v", err)
+	}
+}
+
+// TestListMachinesDiscoversByFailureDomainZoneTags tags the vcsim
+// environment's seeded cluster/host with a region/zone tag pair matching a
+// configured FailureDomain, and checks that ListMachines, with its
+// zoneTagMatcher active on top of the cluster/role custom fields, still
+// discovers a machine placed there.
+func TestListMachinesDiscoversByFailureDomainZoneTags(t *testing.T) {
+	env := vsphereTesting.NewEnvironment(t)
+	ctx := context.Background()
+	spi := &PluginSPIImpl{}
+
+	finder := find.NewFinder(env.Client.Client, true)
+	datacenter, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatalf("finding default datacenter: %v", err)
+	}
+	finder.SetDatacenter(datacenter)
+	cluster, err := finder.DefaultComputeResource(ctx)
+	if err != nil {
+		t.Fatalf("finding default compute cluster: %v", err)
+	}
+	host, err := finder.DefaultHostSystem(ctx)
+	if err != nil {
+		t.Fatalf("finding default host: %v", err)
+	}
+
+	restClient := rest.NewClient(env.Client.Client)
+	if err := restClient.Login(ctx, url.UserPassword(env.Secrets.VsphereUsername, env.Secrets.VspherePassword)); err != nil {
+		t.Fatalf("logging in REST client: %v", err)
+	}
+	defer restClient.Logout(ctx)
+
+	tagsManager := tags.NewManager(restClient)
+	regionCategoryID, err := tagsManager.CreateCategory(ctx, &tags.Category{Name: "region", Cardinality: "SINGLE", AssociableTypes: []string{"ClusterComputeResource"}})
+	if err != nil {
+		t.Fatalf("creating region tag category: %v", err)
+	}
+	zoneCategoryID, err := tagsManager.CreateCategory(ctx, &tags.Category{Name: "zone", Cardinality: "SINGLE", AssociableTypes: []string{"HostSystem"}})
+	if err != nil {
+		t.Fatalf("creating zone tag category: %v", err)
+	}
+	regionTagID, err := tagsManager.CreateTag(ctx, &tags.Tag{Name: "region-a", CategoryID: regionCategoryID})
+	if err != nil {
+		t.Fatalf("creating region tag: %v", err)
+	}
+	zoneTagID, err := tagsManager.CreateTag(ctx, &tags.Tag{Name: "zone-a", CategoryID: zoneCategoryID})
+	if err != nil {
+		t.Fatalf("creating zone tag: %v", err)
+	}
+	if err := tagsManager.AttachTag(ctx, regionTagID, cluster); err != nil {
+		t.Fatalf("attaching region tag to cluster: %v", err)
+	}
+	if err := tagsManager.AttachTag(ctx, zoneTagID, host); err != nil {
+		t.Fatalf("attaching zone tag to host: %v", err)
+	}
+
+	spec := env.Spec
+	spec.Tags = map[string]string{
+		"kubernetes.io/cluster/shoot--test--local": "1",
+		"kubernetes.io/role/worker":                "1",
+	}
+	spec.FailureDomains = []api.FailureDomain{
+		{
+			Name:              "zone-a",
+			RegionTagCategory: "region",
+			RegionTagName:     "region-a",
+			ZoneTagCategory:   "zone",
+			ZoneTagName:       "zone-a",
+		},
+	}
+
+	providerID, err := spi.CreateMachine(ctx, "test-machine-fd", spec, env.Secrets)
+	if err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+
+	machines, err := spi.ListMachines(ctx, spec, env.Secrets)
+	if err != nil {
+		t.Fatalf("ListMachines failed: %v", err)
+	}
+	if _, ok := machines[providerID]; !ok {
+		t.Fatalf("expected ListMachines to discover %q via its failure-domain zone tags, got %v", providerID, machines)
+	}
+}
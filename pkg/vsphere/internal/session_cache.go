@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session/keepalive"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// defaultKeepAliveInterval is how often a cached session is pinged to keep
+// vCenter from expiring it while it sits idle in the cache.
+const defaultKeepAliveInterval = 5 * time.Minute
+
+// sessionCacheKey identifies a cacheable, already-authenticated session.
+type sessionCacheKey struct {
+	host        string
+	username    string
+	insecureSSL bool
+}
+
+// SessionCache hands out authenticated, kept-alive govmomi clients, reusing
+// them across SPI calls instead of logging in and out on every call. It is
+// an interface so tests can inject a fake instead of talking to vCenter.
+type SessionCache interface {
+	// Get returns a client logged in with the given credentials, reusing a
+	// cached session if a validation round-trip shows it is still valid.
+	Get(ctx context.Context, host, username, password string, insecureSSL bool) (*govmomi.Client, error)
+	// Evict drops and logs out the cached session for the given credentials,
+	// if any, forcing the next Get to log in again.
+	Evict(ctx context.Context, host, username string, insecureSSL bool)
+	// Close logs out every cached session. Safe to call more than once.
+	Close(ctx context.Context)
+}
+
+type cachedSession struct {
+	client        *govmomi.Client
+	stopKeepAlive func()
+}
+
+type sessionCache struct {
+	mu        sync.Mutex
+	keepAlive time.Duration
+	sessions  map[sessionCacheKey]*cachedSession
+}
+
+// NewSessionCache creates a SessionCache backed by govmomi's session.Manager
+// that pings cached sessions every keepAlive interval so they don't expire
+// while idle. A keepAlive of 0 uses defaultKeepAliveInterval.
+func NewSessionCache(keepAlive time.Duration) SessionCache {
+	if keepAlive <= 0 {
+		keepAlive = defaultKeepAliveInterval
+	}
+	return &sessionCache{
+		keepAlive: keepAlive,
+		sessions:  map[sessionCacheKey]*cachedSession{},
+	}
+}
+
+func (c *sessionCache) Get(ctx context.Context, host, username, password string, insecureSSL bool) (*govmomi.Client, error) {
+	key := sessionCacheKey{host: host, username: username, insecureSSL: insecureSSL}
+
+	c.mu.Lock()
+	cached, ok := c.sessions[key]
+	c.mu.Unlock()
+
+	if ok {
+		if userSession, err := cached.client.SessionManager.UserSession(ctx); err == nil && userSession != nil {
+			return cached.client, nil
+		}
+		c.Evict(ctx, host, username, insecureSSL)
+	}
+
+	session, err := c.login(ctx, host, username, password, insecureSSL)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.sessions[key] = session
+	c.mu.Unlock()
+
+	return session.client, nil
+}
+
+func (c *sessionCache) login(ctx context.Context, host, username, password string, insecureSSL bool) (*cachedSession, error) {
+	clientURL, err := url.Parse("https://" + host + "/sdk")
+	if err != nil {
+		return nil, err
+	}
+	clientURL.User = url.UserPassword(username, password)
+
+	client, err := govmomi.NewClient(ctx, clientURL, insecureSSL)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := keepalive.NewHandlerSOAP(client.Client, c.keepAlive, func(roundTripper soap.RoundTripper) error {
+		_, err := client.SessionManager.UserSession(context.Background())
+		return err
+	})
+	client.Client.RoundTripper = handler
+	handler.Start()
+
+	return &cachedSession{client: client, stopKeepAlive: handler.Stop}, nil
+}
+
+func (c *sessionCache) Evict(ctx context.Context, host, username string, insecureSSL bool) {
+	key := sessionCacheKey{host: host, username: username, insecureSSL: insecureSSL}
+
+	c.mu.Lock()
+	cached, ok := c.sessions[key]
+	if ok {
+		delete(c.sessions, key)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		cached.stopKeepAlive()
+		cached.client.Logout(ctx)
+	}
+}
+
+func (c *sessionCache) Close(ctx context.Context) {
+	c.mu.Lock()
+	sessions := c.sessions
+	c.sessions = map[sessionCacheKey]*cachedSession{}
+	c.mu.Unlock()
+
+	for _, cached := range sessions {
+		cached.stopKeepAlive()
+		cached.client.Logout(ctx)
+	}
+}
+
+// isNotAuthenticatedError reports whether err is vCenter telling us the
+// session used for the request has expired or was never valid.
+func isNotAuthenticatedError(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+	_, ok := soap.ToSoapFault(err).VimFault().(types.NotAuthenticated)
+	return ok
+}
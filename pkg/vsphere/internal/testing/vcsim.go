@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2019 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package testing provides a vcsim-backed test harness for the vsphere SPI,
+// so that PluginSPIImpl can be exercised against a real VMOMI surface
+// without needing a live vCenter.
+package testing
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+)
+
+// TemplateVMName is the name of the seeded VM that doubles as the clone
+// template in the returned VsphereProviderSpec.
+const TemplateVMName = "DC0_H0_VM0"
+
+// Environment is a running vcsim instance seeded with a datacenter, cluster,
+// datastore, network and template VM, along with the "cluster"/"role"
+// custom field definitions that ListMachines matches on.
+type Environment struct {
+	Model  *simulator.Model
+	Server *simulator.Server
+	Client *govmomi.Client
+
+	// Secrets points at the simulator's SDK endpoint.
+	Secrets *api.Secrets
+	// Spec is a VsphereProviderSpec resolving placement against the seeded
+	// inventory. Tests can add Tags before calling into the SPI.
+	Spec *api.VsphereProviderSpec
+}
+
+// NewEnvironment starts a vcsim server seeded with a minimal inventory and
+// registers t.Cleanup to tear it down once the test finishes.
+func NewEnvironment(t *testing.T) *Environment {
+	t.Helper()
+
+	model := simulator.VPX()
+	model.Datacenter = 1
+	model.Cluster = 1
+	model.Datastore = 1
+	model.Machine = 1
+
+	if err := model.Create(); err != nil {
+		t.Fatalf("creating vcsim model: %v", err)
+	}
+
+	server := model.Service.NewServer()
+
+	ctx := context.Background()
+	client, err := govmomi.NewClient(ctx, server.URL, true)
+	if err != nil {
+		model.Remove()
+		server.Close()
+		t.Fatalf("logging in to vcsim: %v", err)
+	}
+
+	t.Cleanup(func() {
+		client.Logout(ctx)
+		server.Close()
+		model.Remove()
+	})
+
+	finder := find.NewFinder(client.Client, true)
+	datacenter, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatalf("finding default datacenter: %v", err)
+	}
+	finder.SetDatacenter(datacenter)
+
+	cluster, err := finder.DefaultComputeResource(ctx)
+	if err != nil {
+		t.Fatalf("finding default compute cluster: %v", err)
+	}
+	datastore, err := finder.DefaultDatastore(ctx)
+	if err != nil {
+		t.Fatalf("finding default datastore: %v", err)
+	}
+	network, err := finder.DefaultNetwork(ctx)
+	if err != nil {
+		t.Fatalf("finding default network: %v", err)
+	}
+
+	seedCustomFields(ctx, t, client)
+
+	password, _ := server.URL.User.Password()
+	secrets := &api.Secrets{
+		VsphereHost:        server.URL.Host,
+		VsphereUsername:    server.URL.User.Username(),
+		VspherePassword:    password,
+		VsphereInsecureSSL: true,
+		UserData:           "#cloud-config\n",
+	}
+
+	spec := &api.VsphereProviderSpec{
+		Region:         datacenter.Name(),
+		ComputeCluster: cluster.Name(),
+		Datastore:      datastore.Name(),
+		Network:        network.Reference().Value,
+		TemplateVM:     TemplateVMName,
+	}
+
+	return &Environment{
+		Model:   model,
+		Server:  server,
+		Client:  client,
+		Secrets: secrets,
+		Spec:    spec,
+	}
+}
+
+// seedCustomFields registers the "kubernetes.io/cluster/<name>" and
+// "kubernetes.io/role/<name>" custom field definitions ListMachines looks
+// for. It sets no custom values on individual VMs.
+func seedCustomFields(ctx context.Context, t *testing.T, client *govmomi.Client) {
+	t.Helper()
+
+	cfm, err := object.GetCustomFieldsManager(client.Client)
+	if err != nil {
+		t.Fatalf("getting custom fields manager: %v", err)
+	}
+
+	for _, name := range []string{
+		"kubernetes.io/cluster/shoot--test--local",
+		"kubernetes.io/role/worker",
+	} {
+		if _, err := cfm.Add(ctx, name, "VirtualMachine", nil, nil); err != nil {
+			t.Fatalf("adding custom field %q: %v", name, err)
+		}
+	}
+}